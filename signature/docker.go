@@ -0,0 +1,189 @@
+package signature
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/opencontainers/go-digest"
+)
+
+// SignOptions contains options for SignDockerManifestWithOptions /
+// SignManifestWithOptions.
+type SignOptions struct {
+	// Passphrase to use when signing with a passphrase-protected key.
+	//
+	// Deprecated: use PassphraseFunc instead, which does not require
+	// holding the secret in a Go string for as long as SignOptions is
+	// alive. Passphrase is implemented internally as a trivial
+	// PassphraseFunc, and is only consulted if PassphraseFunc is nil.
+	Passphrase string
+
+	// PassphraseFunc, if set, is called once with the fingerprint of the
+	// key being used, before signing. It is called whether or not the key
+	// is passphrase-protected; it is not consulted when UseAgent is set.
+	PassphraseFunc func(keyFingerprint string) ([]byte, error)
+
+	// UseAgent delegates unlocking a passphrase-protected key entirely to
+	// a running gpg-agent: Passphrase and PassphraseFunc are ignored, and
+	// gpg is not passed --passphrase-fd or --pinentry-mode loopback,
+	// letting gpg-agent's own pinentry prompt for (and cache) the
+	// passphrase.
+	UseAgent bool
+}
+
+// passphraseFunc returns the effective passphrase callback for options, or
+// nil if none is configured, i.e. if options is nil, UseAgent is set, or
+// neither PassphraseFunc nor Passphrase was provided.
+func (options *SignOptions) passphraseFunc() func(string) ([]byte, error) {
+	if options == nil || options.UseAgent {
+		return nil
+	}
+	if options.PassphraseFunc != nil {
+		return options.PassphraseFunc
+	}
+	if options.Passphrase != "" {
+		passphrase := options.Passphrase
+		return func(string) ([]byte, error) { return []byte(passphrase), nil }
+	}
+	return nil
+}
+
+// ErrPassphraseRequired is returned by SignDockerManifestWithOptions /
+// SignManifestWithOptions when keyIdentity refers to a passphrase-protected
+// key and options provides no way to unlock it (no Passphrase,
+// PassphraseFunc, or UseAgent).
+type ErrPassphraseRequired struct {
+	// KeyFingerprint is the fingerprint of the key that needs a passphrase.
+	KeyFingerprint string
+}
+
+func (e ErrPassphraseRequired) Error() string {
+	return fmt.Sprintf("key %q requires a passphrase to sign with", e.KeyFingerprint)
+}
+
+// SignDockerManifest returns a signature of manifest as the "docker
+// manifest" of dockerReference, using mech and keyIdentity.
+//
+// Despite the name, manifest need not be a Docker schema2 manifest; it is
+// kept as a synonym for SignManifest, which accepts image manifests,
+// manifest lists and OCI indexes alike, for backwards compatibility with
+// existing callers.
+func SignDockerManifest(m []byte, dockerReference string, mech SigningMechanism, keyIdentity string) ([]byte, error) {
+	return SignManifest(m, dockerReference, mech, keyIdentity)
+}
+
+// SignManifest returns a signature of m — an image manifest, a manifest
+// list or an OCI index, in any of the media types recognized by
+// github.com/containers/image/manifest — as the manifest of
+// dockerReference, using mech and keyIdentity.
+func SignManifest(m []byte, dockerReference string, mech SigningMechanism, keyIdentity string) ([]byte, error) {
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		return nil, err
+	}
+	sig := newUntrustedSignature(manifestDigest, dockerReference)
+	return sig.sign(mech, keyIdentity)
+}
+
+// SignDockerManifestWithOptions returns a signature of manifest as the
+// "docker manifest" of dockerReference, using mech, keyIdentity and
+// options (which may be nil to use the defaults, i.e. no passphrase and no
+// gpg-agent delegation).
+//
+// Despite the name, manifest need not be a Docker schema2 manifest; it is
+// kept as a synonym for SignManifestWithOptions for backwards
+// compatibility with existing callers.
+func SignDockerManifestWithOptions(m []byte, dockerReference string, mech SigningMechanism, keyIdentity string, options *SignOptions) ([]byte, error) {
+	return SignManifestWithOptions(m, dockerReference, mech, keyIdentity, options)
+}
+
+// SignManifestWithOptions returns a signature of m — an image manifest, a
+// manifest list or an OCI index — as the manifest of dockerReference,
+// using mech, keyIdentity and options (which may be nil to use the
+// defaults, i.e. no passphrase and no gpg-agent delegation).
+func SignManifestWithOptions(m []byte, dockerReference string, mech SigningMechanism, keyIdentity string, options *SignOptions) ([]byte, error) {
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := newUntrustedSignature(manifestDigest, dockerReference).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	useAgent := options != nil && options.UseAgent
+	passphraseFunc := options.passphraseFunc()
+
+	mechWithPassphrase, ok := mech.(signingMechanismWithPassphrase)
+	if !ok {
+		if useAgent || passphraseFunc != nil {
+			return nil, errors.New("signing mechanism does not support passphrase-protected keys")
+		}
+		return mech.Sign(payload, keyIdentity)
+	}
+	return mechWithPassphrase.SignWithPassphrase(payload, keyIdentity, passphraseFunc, useAgent)
+}
+
+// VerifyDockerManifestSignature checks that unverifiedSignature uses
+// expectedKeyIdentity to sign unverifiedManifest as expectedDockerReference,
+// using mech, and returns it if so.
+//
+// Despite the name, unverifiedManifest need not be a Docker schema2
+// manifest; it is kept as a synonym for VerifyManifestSignature for
+// backwards compatibility with existing callers.
+func VerifyDockerManifestSignature(unverifiedSignature, unverifiedManifest []byte,
+	expectedDockerReference string, mech SigningMechanism, expectedKeyIdentity string) (*Signature, error) {
+	return VerifyManifestSignature(unverifiedSignature, unverifiedManifest, expectedDockerReference, mech, expectedKeyIdentity)
+}
+
+// VerifyManifestSignature checks that unverifiedSignature uses
+// expectedKeyIdentity to sign unverifiedManifest — an image manifest, a
+// manifest list or an OCI index — as expectedDockerReference, using mech,
+// and returns it if so.
+func VerifyManifestSignature(unverifiedSignature, unverifiedManifest []byte,
+	expectedDockerReference string, mech SigningMechanism, expectedKeyIdentity string) (*Signature, error) {
+	expectedRef, err := reference.ParseNormalizedNamed(expectedDockerReference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected docker reference %q: %w", expectedDockerReference, err)
+	}
+	sig, err := verifyAndExtractSignature(mech, unverifiedSignature, signatureAcceptanceRules{
+		validateKeyIdentity: func(keyIdentity string) error {
+			if keyIdentity != expectedKeyIdentity {
+				return fmt.Errorf("Signature by %s does not match expected fingerprint %s", keyIdentity, expectedKeyIdentity)
+			}
+			return nil
+		},
+		validateSignedDockerReference: func(signedDockerReference string) error {
+			signedRef, err := reference.ParseNormalizedNamed(signedDockerReference)
+			if err != nil {
+				return fmt.Errorf("Invalid docker reference %s in signature", signedDockerReference)
+			}
+			if signedRef.String() != expectedRef.String() {
+				return fmt.Errorf("Docker reference %s does not match %s",
+					signedDockerReference, expectedDockerReference)
+			}
+			return nil
+		},
+		validateSignedDockerManifestDigest: func(signedDigest digest.Digest) error {
+			matches, err := manifest.MatchesDigest(unverifiedManifest, signedDigest)
+			if err != nil {
+				return err
+			}
+			if !matches {
+				manifestDigest, err := manifest.Digest(unverifiedManifest)
+				if err != nil {
+					return err
+				}
+				return fmt.Errorf("Docker manifest digest %s does not match signature %s",
+					manifestDigest, signedDigest)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
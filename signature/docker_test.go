@@ -1,6 +1,7 @@
 package signature
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -77,9 +78,13 @@ func TestSignDockerManifestWithPassphrase(t *testing.T) {
 	_, err = SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, &SignOptions{Passphrase: "wrong"})
 	require.Error(t, err)
 
-	// No passphrase
+	// No passphrase: the signer can't unlock the key and refuses with a
+	// typed error identifying the key.
 	_, err = SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, nil)
 	require.Error(t, err)
+	var passphraseRequired ErrPassphraseRequired
+	require.ErrorAs(t, err, &passphraseRequired)
+	assert.Equal(t, TestKeyFingerprintWithPassphrase, passphraseRequired.KeyFingerprint)
 
 	// Successful signing
 	signature, err := SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, &SignOptions{Passphrase: TestPassphrase})
@@ -90,6 +95,38 @@ func TestSignDockerManifestWithPassphrase(t *testing.T) {
 	assert.Equal(t, TestImageSignatureReference, verified.DockerReference)
 	assert.Equal(t, TestImageManifestDigest, verified.DockerManifestDigest)
 
+	// Callback-based signing
+	var calledWithFingerprint string
+	signature, err = SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, &SignOptions{
+		PassphraseFunc: func(keyFingerprint string) ([]byte, error) {
+			calledWithFingerprint = keyFingerprint
+			return []byte(TestPassphrase), nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, TestKeyFingerprintWithPassphrase, calledWithFingerprint)
+	verified, err = VerifyDockerManifestSignature(signature, manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase)
+	assert.NoError(t, err)
+	assert.Equal(t, TestImageSignatureReference, verified.DockerReference)
+
+	// Callback returning an error
+	callbackErr := errors.New("pinentry cancelled")
+	_, err = SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, &SignOptions{
+		PassphraseFunc: func(string) ([]byte, error) { return nil, callbackErr },
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, callbackErr)
+
+	// Agent-delegated signing: after killing gpg-agent, a fresh agent
+	// instance starts and unlocks the key via its own pinentry, without
+	// this package ever seeing the passphrase.
+	killGPGAgent(t)
+	signature, err = SignDockerManifestWithOptions(manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase, &SignOptions{UseAgent: true})
+	require.NoError(t, err)
+	verified, err = VerifyDockerManifestSignature(signature, manifest, TestImageSignatureReference, mech, TestKeyFingerprintWithPassphrase)
+	assert.NoError(t, err)
+	assert.Equal(t, TestImageSignatureReference, verified.DockerReference)
+
 	// Error computing Docker manifest
 	invalidManifest, err := ioutil.ReadFile("fixtures/v2s1-invalid-signatures.manifest.json")
 	require.NoError(t, err)
@@ -169,3 +206,50 @@ func TestVerifyDockerManifestSignature(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, sig)
 }
+
+func TestSignVerifyManifestOCI(t *testing.T) {
+	mech, err := newGPGSigningMechanismInDirectory(testGPGHomeDirectory)
+	require.NoError(t, err)
+	defer mech.Close()
+
+	if err := mech.SupportsSigning(); err != nil {
+		t.Skipf("Signing not supported: %v", err)
+	}
+
+	// SignManifest/VerifyManifestSignature work on OCI image manifests,
+	// not just the Docker schema2 manifests covered above.
+	ociManifest, err := ioutil.ReadFile("fixtures/oci.manifest.json")
+	require.NoError(t, err)
+
+	signature, err := SignManifest(ociManifest, TestImageSignatureReference, mech, TestKeyFingerprint)
+	require.NoError(t, err)
+
+	verified, err := VerifyManifestSignature(signature, ociManifest, TestImageSignatureReference, mech, TestKeyFingerprint)
+	require.NoError(t, err)
+	assert.Equal(t, TestImageSignatureReference, verified.DockerReference)
+
+	// SignDockerManifest / VerifyDockerManifestSignature are thin
+	// wrappers and accept the same OCI manifest.
+	signature, err = SignDockerManifest(ociManifest, TestImageSignatureReference, mech, TestKeyFingerprint)
+	require.NoError(t, err)
+	_, err = VerifyDockerManifestSignature(signature, ociManifest, TestImageSignatureReference, mech, TestKeyFingerprint)
+	assert.NoError(t, err)
+
+	// The same holds for an OCI image index (a.k.a. Docker manifest
+	// list), which has its own digest distinct from any of the
+	// manifests it references.
+	ociIndex, err := ioutil.ReadFile("fixtures/oci.index.json")
+	require.NoError(t, err)
+
+	signature, err = SignManifest(ociIndex, TestImageSignatureReference, mech, TestKeyFingerprint)
+	require.NoError(t, err)
+
+	verified, err = VerifyManifestSignature(signature, ociIndex, TestImageSignatureReference, mech, TestKeyFingerprint)
+	require.NoError(t, err)
+	assert.Equal(t, TestImageSignatureReference, verified.DockerReference)
+
+	// A signature made over the index must not verify against a
+	// different manifest, here the OCI image manifest signed above.
+	_, err = VerifyManifestSignature(signature, ociManifest, TestImageSignatureReference, mech, TestKeyFingerprint)
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package signature
+
+// signingMechanismWithPassphrase is implemented by SigningMechanisms (such
+// as the GPG one) whose keys may be protected by a passphrase.
+type signingMechanismWithPassphrase interface {
+	SigningMechanism
+
+	// SignWithPassphrase signs input using the key keyIdentity.
+	//
+	// If useAgent is true, passphraseFunc is ignored and unlocking the
+	// key (including any pinentry prompt and caching) is left entirely to
+	// a running gpg-agent, and neither --passphrase-fd nor
+	// --pinentry-mode loopback is passed to gpg. Otherwise, when
+	// passphraseFunc is non-nil, it is called once with the key's
+	// fingerprint to obtain the passphrase before signing; it is called
+	// whether or not the key is passphrase-protected. Otherwise, if the
+	// key is passphrase-protected, SignWithPassphrase fails with
+	// ErrPassphraseRequired.
+	SignWithPassphrase(input []byte, keyIdentity string, passphraseFunc func(keyFingerprint string) ([]byte, error), useAgent bool) ([]byte, error)
+}
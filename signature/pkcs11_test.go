@@ -0,0 +1,32 @@
+package signature
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewPKCS11SigningMechanism only runs when pointed at a real module
+// (e.g. SoftHSM2 in CI); there is no portable way to exercise a PKCS#11
+// token in a unit test otherwise.
+func TestNewPKCS11SigningMechanism(t *testing.T) {
+	modulePath := os.Getenv("PKCS11_TEST_MODULE")
+	if modulePath == "" {
+		t.Skip("PKCS11_TEST_MODULE not set, skipping PKCS#11 test")
+	}
+
+	mech, err := NewPKCS11SigningMechanism(modulePath, 0, os.Getenv("PKCS11_TEST_PIN"), []byte(os.Getenv("PKCS11_TEST_KEY_ID")))
+	require.NoError(t, err)
+	defer mech.Close()
+
+	require.NoError(t, mech.SupportsSigning())
+
+	manifest := []byte(`{"hello":"world"}`)
+	signature, err := mech.Sign(manifest, "")
+	require.NoError(t, err)
+
+	contents, _, err := mech.Verify(signature)
+	require.NoError(t, err)
+	require.Equal(t, manifest, contents)
+}
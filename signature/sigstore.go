@@ -0,0 +1,176 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+)
+
+// sigstorePayloadMediaType is the media type of the "simple signing" payload
+// that cosign embeds in its signature envelopes. It uses the same
+// critical.identity / critical.image schema as the GPG-based signatures in
+// this package, so a verifier only needs to look at the mechanism used to
+// produce the signature bytes, not the payload format.
+const sigstorePayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// sigstoreEnvelope is the on-disk/OCI-attached form of a cosign-style
+// signature: the (base64-encoded, via the []byte JSON encoding) payload,
+// the raw detached signature over that payload, the public key identity
+// used, and an optional Rekor transparency-log entry.
+type sigstoreEnvelope struct {
+	PayloadType string         `json:"payloadType"`
+	Payload     []byte         `json:"payload"`
+	KeyID       string         `json:"keyid,omitempty"`
+	Signature   []byte         `json:"signature"`
+	Rekor       *RekorLogEntry `json:"rekorEntry,omitempty"`
+}
+
+// RekorLogEntry records the subset of a Rekor transparency-log response a
+// caller can attach to a signature via SigstoreSignOptions.Rekor, so that
+// verification can later be extended to check log inclusion. Populating it
+// is optional; a nil *RekorLogEntry means the signature was never (or not
+// yet) logged.
+type RekorLogEntry struct {
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	IntegratedTime int64  `json:"integratedTime"`
+}
+
+// SigstoreSignOptions contains optional parameters for
+// SignDockerManifestSigstoreWithOptions.
+type SigstoreSignOptions struct {
+	// KeyID is recorded in the envelope to help a verifier pick the right
+	// public key out of a keyring; it is not itself trusted.
+	KeyID string
+	// Rekor, if non-nil, is attached to the produced envelope as-is. This
+	// package does not talk to a Rekor instance itself; callers that want
+	// a transparency-log entry are expected to submit the payload and
+	// signature there and pass the result back in.
+	Rekor *RekorLogEntry
+}
+
+// SignDockerManifestSigstoreWithOptions returns a cosign-style signature of
+// m for the docker reference dockerReference, using privateKey. privateKey
+// must be an *ecdsa.PrivateKey or an ed25519.PrivateKey; the signature is a
+// raw ECDSA/Ed25519 signature over the payload, not an OpenPGP packet. It
+// returns the (payload, envelope) pair; the payload is primarily useful for
+// submitting to a transparency log.
+func SignDockerManifestSigstoreWithOptions(m []byte, dockerReference string, privateKey crypto.Signer, opts *SigstoreSignOptions) (payload []byte, envelope []byte, err error) {
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err = newUntrustedSignature(manifestDigest, dockerReference).MarshalJSON()
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling sigstore payload: %w", err)
+	}
+
+	rawSig, err := signSigstorePayload(privateKey, payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating sigstore signature: %w", err)
+	}
+
+	e := sigstoreEnvelope{
+		PayloadType: sigstorePayloadMediaType,
+		Payload:     payload,
+		Signature:   rawSig,
+	}
+	if opts != nil {
+		e.KeyID = opts.KeyID
+		e.Rekor = opts.Rekor
+	}
+	envelope, err = json.Marshal(e)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling sigstore envelope: %w", err)
+	}
+	return payload, envelope, nil
+}
+
+// signSigstorePayload signs payload with privateKey, using SHA-256 for
+// ECDSA keys (Ed25519 hashes internally and rejects a pre-hashed message).
+func signSigstorePayload(privateKey crypto.Signer, payload []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(payload)
+		return ecdsa.SignASN1(rand.Reader, key, digest[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, payload), nil
+	default:
+		return nil, fmt.Errorf("unsupported sigstore private key type %T", privateKey)
+	}
+}
+
+// verifySigstorePayload reports whether rawSig is a valid signature of
+// payload under publicKey.
+func verifySigstorePayload(publicKey crypto.PublicKey, payload, rawSig []byte) error {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(key, digest[:], rawSig) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, rawSig) {
+			return errors.New("Ed25519 signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported sigstore public key type %T", publicKey)
+	}
+}
+
+// VerifyDockerManifestSigstoreSignature checks that envelope is a valid
+// cosign-style signature of unverifiedManifest for expectedDockerReference,
+// made with the private key matching publicKey, and returns the
+// corresponding Signature on success. It mirrors
+// VerifyDockerManifestSignature, only using a raw ECDSA/Ed25519 signature
+// in place of an OpenPGP one.
+func VerifyDockerManifestSigstoreSignature(envelope []byte, unverifiedManifest []byte, expectedDockerReference string, publicKey crypto.PublicKey) (*Signature, error) {
+	expectedRef, err := reference.ParseNormalizedNamed(expectedDockerReference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected docker reference %q: %w", expectedDockerReference, err)
+	}
+
+	var e sigstoreEnvelope
+	if err := json.Unmarshal(envelope, &e); err != nil {
+		return nil, fmt.Errorf("parsing sigstore envelope: %w", err)
+	}
+	if err := verifySigstorePayload(publicKey, e.Payload, e.Signature); err != nil {
+		return nil, fmt.Errorf("verifying sigstore signature: %w", err)
+	}
+
+	var untrusted untrustedSignature
+	if err := json.Unmarshal(e.Payload, &untrusted); err != nil {
+		return nil, fmt.Errorf("parsing sigstore payload: %w", err)
+	}
+
+	signatureRef, err := reference.ParseNormalizedNamed(untrusted.UntrustedDockerReference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker reference in sigstore payload: %w", err)
+	}
+	if signatureRef.String() != expectedRef.String() {
+		return nil, fmt.Errorf("docker reference %q does not match %q", untrusted.UntrustedDockerReference, expectedDockerReference)
+	}
+
+	manifestDigest, err := manifest.Digest(unverifiedManifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifestDigest != untrusted.UntrustedDockerManifestDigest {
+		return nil, fmt.Errorf("docker manifest digest %q does not match signed digest %q", manifestDigest, untrusted.UntrustedDockerManifestDigest)
+	}
+
+	return &Signature{
+		DockerManifestDigest: untrusted.UntrustedDockerManifestDigest,
+		DockerReference:      untrusted.UntrustedDockerReference,
+	}, nil
+}